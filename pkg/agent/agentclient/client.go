@@ -17,36 +17,148 @@ limitations under the License.
 package agentclient
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 	"k8s.io/klog"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
 )
 
+// ClientConfig holds AgentClient behavior that doesn't fit as a
+// positional argument to NewAgentClient.
+type ClientConfig struct {
+	// Keepalive configures gRPC-level keepalive pings on the underlying
+	// HTTP/2 connection. The zero value leaves gRPC's own defaults in
+	// place.
+	Keepalive keepalive.ClientParameters
+
+	// PingInterval is how often the agent sends a PacketType_PING on an
+	// established stream to verify liveness at the agent-proxy protocol
+	// layer. This catches a dead connection even when HTTP/2 keepalive
+	// is stripped by an intermediate load balancer. Zero disables
+	// application-level pings.
+	PingInterval time.Duration
+
+	// Identity is presented to the proxy server on stream establishment,
+	// both as transport/per-RPC credentials and as the payload of a
+	// PacketType_REGISTER packet. The zero value registers no identity.
+	Identity AgentIdentity
+
+	// DialTimeout bounds how long a DIAL_REQ is allowed to take. Zero
+	// means no timeout. Ignored if Dialer is set.
+	DialTimeout time.Duration
+
+	// Dialer opens the connections requested by DIAL_REQ packets. If
+	// nil, a plain net.Dialer bounded by DialTimeout is used. Set this
+	// to NewHTTPConnectDialer or NewSOCKS5Dialer to egress through a
+	// corporate proxy instead of dialing directly.
+	Dialer Dialer
+
+	// DataChannelSize is the high-watermark queue length, per connection,
+	// of DATA payloads waiting to be written to the remote endpoint. Once
+	// a connection's backlog reaches this many packets, the agent asks
+	// the proxy server to pause that connID with FLOW_CONTROL until the
+	// backlog drains back to half this size. Zero means the default of
+	// 5, matched to the prior hardcoded channel size.
+	//
+	// The queue's hard cap, past which the agent gives up on the pause
+	// being honored and closes the connection instead, is
+	// queueOverflowFactor times this.
+	DataChannelSize int
+
+	// Interceptors run, in order, around every packet Serve receives and
+	// every packet Send/RetrySend transmits. See MetricsInterceptor and
+	// NewLoggingInterceptor for built-ins.
+	Interceptors []AgentInterceptor
+}
+
+func (cfg ClientConfig) dataChannelSize() int {
+	if cfg.DataChannelSize > 0 {
+		return cfg.DataChannelSize
+	}
+	return 5
+}
+
+// queueOverflowFactor bounds a connContext's dataQueue hard cap as a
+// multiple of its pause watermark (dataChannelSize): if a backlog grows
+// this far past the watermark despite an outstanding FLOW_CONTROL
+// pause, the proxy server isn't honoring it, and the agent closes the
+// connection rather than let the queue grow without bound.
+const queueOverflowFactor = 8
+
 // AgentClient runs on the node network side. It connects to proxy server and establishes
 // a stream connection from which it sends and receives network traffic.
 type AgentClient struct {
-	nextConnID  int64
-	connContext map[int64]*connContext
+	nextConnID    int64
+	connIDCounter *int64
+	connections   *connRegistry
+
+	serverAddress string
+	stream        *RedialableAgentClient
+
+	dialer Dialer
 
-	stream *RedialableAgentClient
+	pendingDialsMu sync.Mutex
+	pendingDials   map[int64]context.CancelFunc
+
+	chains packetChains
+
+	cfg      ClientConfig
+	lastPong int64 // unix nanoseconds, accessed atomically
 }
 
 // NewAgentClient creates an AgentClient
-func NewAgentClient(address string, opts ...grpc.DialOption) (*AgentClient, error) {
+func NewAgentClient(address string, cfg ClientConfig, opts ...grpc.DialOption) (*AgentClient, error) {
+	if cfg.Keepalive.Time > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(cfg.Keepalive))
+	}
+
+	identityOpts, err := cfg.Identity.dialOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, identityOpts...)
+
 	stream, err := NewRedialableAgentClient(address, opts...)
 	if err != nil {
 		return nil, err
 	}
 
+	dialer := cfg.Dialer
+	if dialer == nil {
+		dialer = defaultDialer(cfg.DialTimeout)
+	}
+
 	a := &AgentClient{
-		connContext: make(map[int64]*connContext),
-		stream:      stream,
+		connections:   newConnRegistry(),
+		serverAddress: address,
+		stream:        stream,
+		dialer:        dialer,
+		pendingDials:  make(map[int64]context.CancelFunc),
+		cfg:           cfg,
+	}
+	a.connIDCounter = &a.nextConnID
+	a.chains = newPacketChains(a, cfg.Interceptors)
+	return a, nil
+}
+
+// newAgentClientWithConnIDCounter creates an AgentClient that allocates
+// connIDs from counter instead of its own. It is used by AgentClientSet
+// to give every server an agent is registered with a view into a single,
+// global connID namespace.
+func newAgentClientWithConnIDCounter(address string, counter *int64, cfg ClientConfig, opts ...grpc.DialOption) (*AgentClient, error) {
+	a, err := NewAgentClient(address, cfg, opts...)
+	if err != nil {
+		return nil, err
 	}
+	a.connIDCounter = counter
 	return a, nil
 }
 
@@ -54,8 +166,14 @@ func NewAgentClient(address string, opts ...grpc.DialOption) (*AgentClient, erro
 type connContext struct {
 	conn      net.Conn
 	cleanFunc func()
-	dataCh    chan []byte
+	queue     *dataQueue
 	cleanOnce sync.Once
+
+	// paused is 1 while the agent has told the proxy server to pause
+	// this connID's DATA, 0 otherwise. Accessed atomically so the Serve
+	// goroutine (pausing) and proxyToRemote (resuming) don't race on
+	// sending duplicate FLOW_CONTROL packets.
+	paused int32
 }
 
 func (c *connContext) cleanup() {
@@ -76,10 +194,21 @@ func (c *connContext) cleanup() {
 // The requests include things like opening a connection to a server,
 // streaming data and close the connection.
 func (a *AgentClient) Serve(stopCh <-chan struct{}) {
+	if a.cfg.Identity.AgentID != "" {
+		if err := a.registerWithRetry(); err != nil {
+			klog.Errorf("failed to register identity after %d attempts, agent will be unroutable until the next reconnect: %v", registerRetryAttempts, err)
+		}
+	}
+
+	if a.cfg.PingInterval > 0 {
+		go a.pingLoop(stopCh)
+	}
+
 	for {
 		select {
 		case <-stopCh:
 			klog.Info("stop agent client.")
+			a.cancelPendingDials()
 			return
 		default:
 		}
@@ -90,6 +219,13 @@ func (a *AgentClient) Serve(stopCh <-chan struct{}) {
 				err3 := err2.Wait()
 				if err3 != nil {
 					klog.Warningf("reconnect error: %v", err3)
+				} else if a.cfg.Identity.AgentID != "" {
+					// The new stream underneath us knows nothing about
+					// this agent's identity/labels, so the proxy server
+					// can't route to it until we register again.
+					if err := a.register(); err != nil {
+						klog.Warningf("failed to re-register identity after reconnect: %v", err)
+					}
 				}
 				continue
 			} else if err == io.EOF {
@@ -103,76 +239,45 @@ func (a *AgentClient) Serve(stopCh <-chan struct{}) {
 			return
 		}
 
-		klog.Infof("[tracing] recv packet %+v", pkt)
-
 		if pkt == nil {
 			klog.Warningf("empty packet received")
 			continue
 		}
 
+		if err := a.dispatchInbound(pkt); err != nil {
+			klog.Warningf("inbound interceptor rejected packet: %v", err)
+			continue
+		}
+
 		switch pkt.Type {
 		case agent.PacketType_DIAL_REQ:
 			klog.Info("received DIAL_REQ")
-			resp := &agent.Packet{
-				Type:    agent.PacketType_DIAL_RSP,
-				Payload: &agent.Packet_DialResponse{DialResponse: &agent.DialResponse{}},
-			}
-
-			dialReq := pkt.GetDialRequest()
-			resp.GetDialResponse().Random = dialReq.Random
-
-			conn, err := net.Dial(dialReq.Protocol, dialReq.Address)
-			if err != nil {
-				resp.GetDialResponse().Error = err.Error()
-				if err := a.stream.RetrySend(resp); err != nil {
-					klog.Warningf("stream send error: %v", err)
-				}
-				continue
-			}
-
-			connID := atomic.AddInt64(&a.nextConnID, 1)
-			dataCh := make(chan []byte, 5)
-			a.connContext[connID] = &connContext{
-				conn:   conn,
-				dataCh: dataCh,
-				cleanFunc: func() {
-					klog.Infof("close connection(id=%d)", connID)
-					resp := &agent.Packet{
-						Type:    agent.PacketType_CLOSE_RSP,
-						Payload: &agent.Packet_CloseResponse{CloseResponse: &agent.CloseResponse{}},
-					}
-					resp.GetCloseResponse().ConnectID = connID
-
-					err := conn.Close()
-					if err != nil {
-						resp.GetCloseResponse().Error = err.Error()
-					}
-
-					if err := a.stream.RetrySend(resp); err != nil {
-						klog.Warningf("close response send error: %v", err)
-					}
-
-					close(dataCh)
-					delete(a.connContext, connID)
-				},
-			}
-
-			resp.GetDialResponse().ConnectID = connID
-			if err := a.stream.RetrySend(resp); err != nil {
-				klog.Warningf("stream send error: %v", err)
-				continue
-			}
-
-			go a.remoteToProxy(conn, connID)
-			go a.proxyToRemote(conn, connID)
+			go a.handleDialRequest(pkt)
 
 		case agent.PacketType_DATA:
 			data := pkt.GetData()
 			klog.Infof("received DATA(id=%d)", data.ConnectID)
-			klog.Infof("[tracing] %v", data)
 
-			if ctx, ok := a.connContext[data.ConnectID]; ok {
-				ctx.dataCh <- data.Data
+			if ctx, ok := a.connections.Get(data.ConnectID); ok {
+				// Push never blocks, so a slow remote endpoint can only
+				// ever back up its own connID's queue, never stall Recv
+				// here for every other connID. Once the backlog passes
+				// the high watermark, ask the proxy server to pause;
+				// proxyToRemote asks it to resume once the backlog
+				// drains.
+				n, pushed := ctx.queue.Push(data.Data)
+				if !pushed {
+					// The queue hit its hard cap despite an outstanding
+					// pause, so the proxy server isn't honoring
+					// FLOW_CONTROL. Drop the connection instead of
+					// growing the backlog without bound.
+					klog.Warningf("connection(id=%d) backlog exceeded hard cap, closing", data.ConnectID)
+					ctx.cleanup()
+					continue
+				}
+				if n >= a.cfg.dataChannelSize() && atomic.CompareAndSwapInt32(&ctx.paused, 0, 1) {
+					a.sendFlowControl(data.ConnectID, true)
+				}
 			}
 
 		case agent.PacketType_CLOSE_REQ:
@@ -181,8 +286,13 @@ func (a *AgentClient) Serve(stopCh <-chan struct{}) {
 
 			klog.Infof("received CLOSE_REQ(id=%d)", connID)
 
-			if ctx, ok := a.connContext[connID]; ok {
+			if ctx, ok := a.connections.Get(connID); ok {
 				ctx.cleanup()
+			} else if a.cancelPendingDial(closeReq.Random) {
+				// connID is only assigned once a dial succeeds, so a
+				// CLOSE_REQ racing a still-in-flight DIAL_REQ can't name
+				// a connID yet; it names the dial's Random instead.
+				klog.Infof("cancelled in-flight dial(random=%d) on CLOSE_REQ", closeReq.Random)
 			} else {
 				resp := &agent.Packet{
 					Type:    agent.PacketType_CLOSE_RSP,
@@ -190,21 +300,239 @@ func (a *AgentClient) Serve(stopCh <-chan struct{}) {
 				}
 				resp.GetCloseResponse().ConnectID = connID
 				resp.GetCloseResponse().Error = "Unknown connectID"
-				if err := a.stream.Send(resp); err != nil {
+				if err := a.sendPacket(resp); err != nil {
 					klog.Warningf("close response send error: %v", err)
 					continue
 				}
 			}
 
+		case agent.PacketType_PONG:
+			atomic.StoreInt64(&a.lastPong, time.Now().UnixNano())
+
 		default:
 			klog.Warningf("unrecognized packet type: %+v", pkt)
 		}
 	}
 }
 
+// handleDialRequest dials the target named by a DIAL_REQ and reports the
+// outcome as a DIAL_RSP. The dial runs with a context that is cancelled
+// if a CLOSE_REQ names this dial's Random, or the agent is asked to stop,
+// before the dial completes. The context carries no deadline of its own;
+// cfg.DialTimeout applies only through the default Dialer.
+func (a *AgentClient) handleDialRequest(pkt *agent.Packet) {
+	dialReq := pkt.GetDialRequest()
+
+	resp := &agent.Packet{
+		Type:    agent.PacketType_DIAL_RSP,
+		Payload: &agent.Packet_DialResponse{DialResponse: &agent.DialResponse{}},
+	}
+	resp.GetDialResponse().Random = dialReq.Random
+
+	start := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.pendingDialsMu.Lock()
+	a.pendingDials[dialReq.Random] = cancel
+	a.pendingDialsMu.Unlock()
+	defer func() {
+		a.pendingDialsMu.Lock()
+		delete(a.pendingDials, dialReq.Random)
+		a.pendingDialsMu.Unlock()
+		cancel()
+	}()
+
+	conn, err := a.dialer(ctx, dialReq.Protocol, dialReq.Address)
+	observeDialLatency(time.Since(start))
+	if err != nil {
+		recordDialError(dialReq.Protocol)
+		resp.GetDialResponse().Error = err.Error()
+		resp.GetDialResponse().ErrorCode = dialErrorCode(err)
+		if err := a.sendPacketRetry(resp); err != nil {
+			klog.Warningf("stream send error: %v", err)
+		}
+		return
+	}
+
+	connID := atomic.AddInt64(a.connIDCounter, 1)
+	queue := newDataQueue(a.cfg.dataChannelSize() * queueOverflowFactor)
+	a.connections.Add(connID, &connContext{
+		conn:  conn,
+		queue: queue,
+		cleanFunc: func() {
+			klog.Infof("close connection(id=%d)", connID)
+			resp := &agent.Packet{
+				Type:    agent.PacketType_CLOSE_RSP,
+				Payload: &agent.Packet_CloseResponse{CloseResponse: &agent.CloseResponse{}},
+			}
+			resp.GetCloseResponse().ConnectID = connID
+
+			err := conn.Close()
+			if err != nil {
+				resp.GetCloseResponse().Error = err.Error()
+			}
+
+			if err := a.sendPacketRetry(resp); err != nil {
+				klog.Warningf("close response send error: %v", err)
+			}
+
+			queue.Close()
+			a.connections.Delete(connID)
+		},
+	})
+
+	resp.GetDialResponse().ConnectID = connID
+	if err := a.sendPacketRetry(resp); err != nil {
+		klog.Warningf("stream send error: %v", err)
+		return
+	}
+
+	go a.remoteToProxy(conn, connID)
+	go a.proxyToRemote(conn, connID)
+}
+
+// cancelPendingDial cancels the in-flight dial keyed by random, if any,
+// so a CLOSE_REQ that arrives before a DIAL_RSP can abort the dial
+// instead of racing it to completion. It reports whether a matching
+// dial was found.
+//
+// This is one half of a protocol contract with the proxy server: the
+// server must populate CloseRequest.Random (not ConnectID, which the
+// agent hasn't assigned yet) when it wants to abort a dial it hasn't
+// seen a DialResponse for. The proxy server side of that contract lives
+// outside this package and isn't implemented here.
+func (a *AgentClient) cancelPendingDial(random int64) bool {
+	a.pendingDialsMu.Lock()
+	defer a.pendingDialsMu.Unlock()
+
+	cancel, ok := a.pendingDials[random]
+	if !ok {
+		return false
+	}
+	cancel()
+	delete(a.pendingDials, random)
+	return true
+}
+
+// cancelPendingDials cancels every dial still in flight, so a teardown
+// doesn't leave a goroutine blocked in a dial that nothing is waiting
+// on anymore.
+func (a *AgentClient) cancelPendingDials() {
+	a.pendingDialsMu.Lock()
+	defer a.pendingDialsMu.Unlock()
+	for random, cancel := range a.pendingDials {
+		cancel()
+		delete(a.pendingDials, random)
+	}
+}
+
+// dialErrorCode classifies a dial error into the structured codes
+// carried on DialResponse, so a caller can distinguish e.g. a timeout
+// from a refused connection without string-matching Error. net.Dialer
+// (and the context package itself) wrap context.DeadlineExceeded and
+// context.Canceled in a *net.OpError rather than returning them
+// directly, so these must be unwrapped with errors.Is rather than
+// compared with ==.
+func dialErrorCode(err error) agent.DialError {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return agent.DialError_DIAL_ERROR_TIMEOUT
+	case errors.Is(err, context.Canceled):
+		return agent.DialError_DIAL_ERROR_CANCELED
+	default:
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return agent.DialError_DIAL_ERROR_TIMEOUT
+		}
+		return agent.DialError_DIAL_ERROR_UNKNOWN
+	}
+}
+
+// sendFlowControl tells the proxy server to pause (or resume) forwarding
+// DATA for connID, the agent-side half of an HTTP/2-style per-stream
+// flow control window on top of the gRPC multiplex.
+func (a *AgentClient) sendFlowControl(connID int64, pause bool) {
+	pkt := &agent.Packet{
+		Type: agent.PacketType_FLOW_CONTROL,
+		Payload: &agent.Packet_FlowControl{FlowControl: &agent.FlowControl{
+			ConnectID: connID,
+			Pause:     pause,
+		}},
+	}
+	if err := a.sendPacket(pkt); err != nil {
+		klog.Warningf("flow control send error: %v", err)
+	}
+}
+
+// registerRetryAttempts bounds how many times in all registerWithRetry
+// attempts a register, so an initial register that loses a race with the
+// stream still finishing setup gets a chance to succeed a moment later
+// instead of leaving the agent permanently unroutable for the life of
+// the connection.
+const registerRetryAttempts = 3
+
+// registerWithRetry calls register, making up to registerRetryAttempts
+// attempts in all with a short backoff between them. It returns the last
+// error if every attempt fails.
+func (a *AgentClient) registerWithRetry() error {
+	var err error
+	for attempt := 1; attempt <= registerRetryAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+
+		if err = a.register(); err == nil {
+			return nil
+		}
+		klog.Warningf("register attempt %d/%d failed: %v", attempt, registerRetryAttempts, err)
+	}
+	return err
+}
+
+// register sends a PacketType_REGISTER packet carrying the agent's
+// identity and labels, so the proxy server can route dials to this
+// agent based on them (e.g. a region= label).
+func (a *AgentClient) register() error {
+	pkt := &agent.Packet{
+		Type: agent.PacketType_REGISTER,
+		Payload: &agent.Packet_Register{Register: &agent.RegisterRequest{
+			AgentID: a.cfg.Identity.AgentID,
+			Labels:  a.cfg.Identity.Labels,
+		}},
+	}
+	return a.sendPacket(pkt)
+}
+
+// pingLoop sends a PacketType_PING every cfg.PingInterval and redials the
+// stream if no PONG has been seen for 2*cfg.PingInterval, so a dead TCP
+// connection doesn't leave Recv blocked forever.
+func (a *AgentClient) pingLoop(stopCh <-chan struct{}) {
+	atomic.StoreInt64(&a.lastPong, time.Now().UnixNano())
+
+	ticker := time.NewTicker(a.cfg.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			ping := &agent.Packet{Type: agent.PacketType_PING}
+			if err := a.sendPacket(ping); err != nil {
+				klog.Warningf("ping send error: %v", err)
+			}
+
+			lastPong := time.Unix(0, atomic.LoadInt64(&a.lastPong))
+			if time.Since(lastPong) > 2*a.cfg.PingInterval {
+				klog.Warningf("no PONG received in %v, redialing stream", 2*a.cfg.PingInterval)
+				a.stream.Close()
+			}
+		}
+	}
+}
+
 func (a *AgentClient) remoteToProxy(conn net.Conn, connID int64) {
-	ctx := a.connContext[connID]
-	if ctx == nil {
+	ctx, ok := a.connections.Get(connID)
+	if !ok {
 		return
 	}
 
@@ -231,7 +559,7 @@ func (a *AgentClient) remoteToProxy(conn net.Conn, connID int64) {
 				Data:      buf[:n],
 				ConnectID: connID,
 			}}
-			if err := a.stream.RetrySend(resp); err != nil {
+			if err := a.sendPacketRetry(resp); err != nil {
 				klog.Warningf("stream send error: %v", err)
 			}
 		}
@@ -239,14 +567,25 @@ func (a *AgentClient) remoteToProxy(conn net.Conn, connID int64) {
 }
 
 func (a *AgentClient) proxyToRemote(conn net.Conn, connID int64) {
-	ctx := a.connContext[connID]
-	if ctx == nil {
+	ctx, ok := a.connections.Get(connID)
+	if !ok {
 		return
 	}
 
 	defer ctx.cleanup()
 
-	for d := range ctx.dataCh {
+	lowWatermark := a.cfg.dataChannelSize() / 2
+
+	for {
+		d, remaining, ok := ctx.queue.Pop()
+		if !ok {
+			return
+		}
+
+		if remaining <= lowWatermark && atomic.CompareAndSwapInt32(&ctx.paused, 1, 0) {
+			a.sendFlowControl(connID, false)
+		}
+
 		pos := 0
 		for {
 			n, err := conn.Write(d[pos:])
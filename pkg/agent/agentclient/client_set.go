@@ -0,0 +1,128 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentclient
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+)
+
+// ServerResolver returns the set of proxy-server addresses an
+// AgentClientSet should currently be registered with. It is called again
+// on every rebalance, so servers can be added to or removed from a live
+// fleet without restarting the agent.
+type ServerResolver func() ([]string, error)
+
+// AgentClientSet owns one AgentClient per resolved proxy-server address,
+// so a single agent can register as a backend on a fleet of proxy
+// servers instead of just one. connIDs are allocated from a single
+// namespace shared by every member client, mirroring the grpclb pattern
+// of one client fanning out to several backend endpoints.
+type AgentClientSet struct {
+	mu      sync.Mutex
+	clients map[string]*AgentClient
+
+	nextConnID int64
+
+	resolve         ServerResolver
+	rebalancePeriod time.Duration
+	cfg             ClientConfig
+	dialOpts        []grpc.DialOption
+}
+
+// NewAgentClientSet creates an AgentClientSet. Call Serve to connect to
+// the resolved servers and start serving proxy requests on each of them.
+// cfg is applied to every member AgentClient.
+func NewAgentClientSet(resolve ServerResolver, cfg ClientConfig, opts ...grpc.DialOption) *AgentClientSet {
+	return &AgentClientSet{
+		clients:         make(map[string]*AgentClient),
+		resolve:         resolve,
+		rebalancePeriod: 10 * time.Second,
+		cfg:             cfg,
+		dialOpts:        opts,
+	}
+}
+
+// Serve connects to every address currently returned by the resolver and
+// serves proxy requests from each of them until stopCh is closed. It
+// periodically re-resolves and connects to new servers, and drops a
+// client as soon as its stream terminates (RST or EOF) so that a later
+// rebalance can redial it if it is still wanted.
+func (s *AgentClientSet) Serve(stopCh <-chan struct{}) {
+	s.rebalance(stopCh)
+
+	ticker := time.NewTicker(s.rebalancePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			s.rebalance(stopCh)
+		}
+	}
+}
+
+// rebalance resolves the desired server set and connects any address
+// that doesn't have a client yet. It does not proactively disconnect
+// clients for addresses that disappear from the resolver; those clients
+// are left running and are cleaned up by drop once their stream ends,
+// to avoid tearing down a healthy connection on a transient resolver
+// hiccup.
+func (s *AgentClientSet) rebalance(stopCh <-chan struct{}) {
+	addrs, err := s.resolve()
+	if err != nil {
+		klog.Warningf("agent client set: resolve error: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, addr := range addrs {
+		if _, ok := s.clients[addr]; ok {
+			continue
+		}
+
+		client, err := newAgentClientWithConnIDCounter(addr, &s.nextConnID, s.cfg, s.dialOpts...)
+		if err != nil {
+			klog.Warningf("agent client set: failed to connect to %q: %v", addr, err)
+			continue
+		}
+
+		s.clients[addr] = client
+		klog.Infof("agent client set: connected to %q", addr)
+
+		go func(addr string, client *AgentClient) {
+			client.Serve(stopCh)
+			s.drop(addr)
+		}(addr, client)
+	}
+}
+
+// drop removes addr's client once its stream has terminated, so a later
+// rebalance can redial it if the resolver still wants it.
+func (s *AgentClientSet) drop(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	klog.Infof("agent client set: disconnected from %q", addr)
+	delete(s.clients, addr)
+}
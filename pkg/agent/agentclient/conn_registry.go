@@ -0,0 +1,55 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentclient
+
+import "sync"
+
+// connRegistry is a concurrency-safe store of the connContexts backing
+// an AgentClient's in-flight connections. It replaces a bare map that
+// used to be read and written from Serve, remoteToProxy, proxyToRemote
+// and the per-connection cleanup closure without any synchronization,
+// which raced under concurrent DIAL/DATA/CLOSE handling.
+type connRegistry struct {
+	mu    sync.RWMutex
+	conns map[int64]*connContext
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[int64]*connContext)}
+}
+
+// Add registers ctx under connID.
+func (r *connRegistry) Add(connID int64, ctx *connContext) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[connID] = ctx
+}
+
+// Get returns the connContext for connID, if any.
+func (r *connRegistry) Get(connID int64) (*connContext, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ctx, ok := r.conns[connID]
+	return ctx, ok
+}
+
+// Delete removes connID from the registry.
+func (r *connRegistry) Delete(connID int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, connID)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentclient
+
+import "sync"
+
+// dataQueue is a FIFO of DATA payloads waiting to be written to a
+// connContext's remote connection. Push never blocks, so the Serve
+// goroutine (which also owns Recv for the whole multiplexed stream) can
+// always hand off a DATA packet without risking a stall on some other
+// connID's slow remote endpoint; backpressure is instead signalled to
+// the proxy server via FLOW_CONTROL once the queue grows past a
+// watermark, using the length Push and Pop report back to the caller.
+//
+// The queue still has a hard cap, well past that watermark: nothing
+// today requires the proxy server to honor FLOW_CONTROL, so a peer that
+// ignores the pause must not be able to grow this queue without bound.
+type dataQueue struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	items  [][]byte
+	limit  int
+	closed bool
+}
+
+// newDataQueue returns a dataQueue that refuses pushes once it holds
+// limit items. limit <= 0 means no cap.
+func newDataQueue(limit int) *dataQueue {
+	q := &dataQueue{limit: limit}
+	q.cond.L = &q.mu
+	return q
+}
+
+// Push appends data to the queue and returns the queue length after the
+// push, so the caller can decide whether to ask the proxy server to
+// pause. pushed is false, and data is discarded, if the queue was
+// already at its hard cap; the caller should treat that as fatal for
+// the connection rather than let the queue keep growing.
+func (q *dataQueue) Push(data []byte) (n int, pushed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.limit > 0 && len(q.items) >= q.limit {
+		return len(q.items), false
+	}
+
+	q.items = append(q.items, data)
+	q.cond.Signal()
+	return len(q.items), true
+}
+
+// Pop blocks until data is available or the queue is closed. remaining
+// is the queue length after the pop, so the caller can tell when the
+// backlog has drained enough to ask the proxy server to resume. ok is
+// false once the queue is closed and fully drained.
+func (q *dataQueue) Pop() (data []byte, remaining int, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, 0, false
+	}
+
+	data, q.items = q.items[0], q.items[1:]
+	return data, len(q.items), true
+}
+
+// Close marks the queue closed and wakes any goroutine blocked in Pop.
+func (q *dataQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer opens a connection to address over network on behalf of a
+// DIAL_REQ. It must honor ctx so a dial that takes too long, or whose
+// connection is no longer wanted, can be cancelled by the caller.
+type Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+// defaultDialer is the Dialer used when ClientConfig.Dialer is nil: a
+// plain net.Dialer bounded by timeout.
+func defaultDialer(timeout time.Duration) Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	return d.DialContext
+}
+
+// NewHTTPConnectDialer returns a Dialer that egresses through the HTTP
+// proxy at proxyAddress, opening a CONNECT tunnel to the DIAL_REQ's
+// target before handing the tunnel back as the connection.
+func NewHTTPConnectDialer(proxyAddress string) Dialer {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", proxyAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial HTTP proxy %q: %v", proxyAddress, err)
+		}
+
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to write CONNECT request to %q: %v", proxyAddress, err)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to read CONNECT response from %q: %v", proxyAddress, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("CONNECT %q via %q failed: %s", address, proxyAddress, resp.Status)
+		}
+
+		return conn, nil
+	}
+}
+
+// NewSOCKS5Dialer returns a Dialer that egresses through the SOCKS5
+// proxy at proxyAddress.
+func NewSOCKS5Dialer(proxyAddress string, auth *proxy.Auth) (Dialer, error) {
+	d, err := proxy.SOCKS5("tcp", proxyAddress, auth, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build SOCKS5 dialer for %q: %v", proxyAddress, err)
+	}
+
+	if ctxDialer, ok := d.(proxy.ContextDialer); ok {
+		return ctxDialer.DialContext, nil
+	}
+
+	// The SOCKS5 dialer returned by golang.org/x/net/proxy always
+	// implements ContextDialer; this is a defensive fallback in case it
+	// doesn't. The fallback ignores ctx.
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return d.Dial(network, address)
+	}, nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// AgentIdentity describes how an agent presents itself to a proxy
+// server: the agent ID it registers under, labels the server can route
+// on (e.g. a region= label restricting egress to agents in one region),
+// and optionally the credentials used to secure and authenticate the
+// stream.
+type AgentIdentity struct {
+	// AgentID uniquely identifies this agent to the proxy server.
+	AgentID string
+	// Labels are attached to the agent's registration so the proxy
+	// server can select among agents when dialing.
+	Labels map[string]string
+
+	// TLSCertFile and TLSKeyFile, if both set, are used to build
+	// transport credentials presenting this agent's client certificate
+	// to the proxy server (mTLS).
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSCAFile, if set alongside TLSCertFile and TLSKeyFile, is used to
+	// validate the proxy server's certificate instead of the host's root
+	// CA pool. It is ignored unless both of those are set.
+	TLSCAFile string
+
+	// TokenSource, if set, is attached as per-RPC credentials, e.g. to
+	// carry a bearer token alongside the identity above.
+	TokenSource credentials.PerRPCCredentials
+}
+
+// dialOptions builds the grpc.DialOptions needed to present id on the
+// wire. They are combined with any dial options the caller of
+// NewAgentClient supplies directly.
+func (id AgentIdentity) dialOptions() ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+
+	if id.TLSCertFile != "" && id.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(id.TLSCertFile, id.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load agent certificate: %v", err)
+		}
+
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+		if id.TLSCAFile != "" {
+			ca, err := ioutil.ReadFile(id.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file %q: %v", id.TLSCAFile, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("failed to parse CA file %q", id.TLSCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	}
+
+	if id.TokenSource != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(id.TokenSource))
+	}
+
+	return opts, nil
+}
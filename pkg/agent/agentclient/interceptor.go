@@ -0,0 +1,98 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentclient
+
+import (
+	"context"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+// Direction says whether an AgentInterceptor is seeing a packet the
+// agent received from, or is about to send to, the proxy server.
+type Direction int
+
+const (
+	// Inbound packets were just read off the stream by Serve.
+	Inbound Direction = iota
+	// Outbound packets are about to be written to the stream by Send or
+	// RetrySend.
+	Outbound
+)
+
+// AgentInterceptor is invoked for every packet Serve receives and every
+// packet Send/RetrySend transmits. It must call next to continue
+// processing the packet; returning without calling next (or returning a
+// non-nil error) short-circuits the chain.
+type AgentInterceptor func(ctx context.Context, dir Direction, pkt *agent.Packet, next func(context.Context, *agent.Packet) error) error
+
+// chainInterceptors composes interceptors into a single call that runs
+// them in order, each wrapping the next, with final at the center of the
+// chain.
+func chainInterceptors(interceptors []AgentInterceptor, dir Direction, final func(context.Context, *agent.Packet) error) func(context.Context, *agent.Packet) error {
+	handler := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor := interceptors[i]
+		next := handler
+		handler = func(ctx context.Context, pkt *agent.Packet) error {
+			return interceptor(ctx, dir, pkt, next)
+		}
+	}
+	return handler
+}
+
+// packetChains holds the three interceptor chains an AgentClient runs
+// packets through, built once from cfg.Interceptors so the hot paths in
+// Serve and the pump goroutines don't re-wrap the chain on every packet.
+type packetChains struct {
+	send      func(context.Context, *agent.Packet) error
+	sendRetry func(context.Context, *agent.Packet) error
+	inbound   func(context.Context, *agent.Packet) error
+}
+
+func newPacketChains(a *AgentClient, interceptors []AgentInterceptor) packetChains {
+	return packetChains{
+		send: chainInterceptors(interceptors, Outbound, func(_ context.Context, p *agent.Packet) error {
+			return a.stream.Send(p)
+		}),
+		sendRetry: chainInterceptors(interceptors, Outbound, func(_ context.Context, p *agent.Packet) error {
+			return a.stream.RetrySend(p)
+		}),
+		inbound: chainInterceptors(interceptors, Inbound, func(context.Context, *agent.Packet) error {
+			return nil
+		}),
+	}
+}
+
+// sendPacket runs pkt through the outbound interceptor chain and then
+// writes it with stream.Send.
+func (a *AgentClient) sendPacket(pkt *agent.Packet) error {
+	return a.chains.send(context.Background(), pkt)
+}
+
+// sendPacketRetry runs pkt through the outbound interceptor chain and
+// then writes it with stream.RetrySend.
+func (a *AgentClient) sendPacketRetry(pkt *agent.Packet) error {
+	return a.chains.sendRetry(context.Background(), pkt)
+}
+
+// dispatchInbound runs pkt through the inbound interceptor chain. The
+// chain can only observe or reject an inbound packet; the actual
+// handling in Serve's switch runs afterwards, once the chain accepts it.
+func (a *AgentClient) dispatchInbound(pkt *agent.Packet) error {
+	return a.chains.inbound(context.Background(), pkt)
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentclient
+
+import (
+	"context"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+// NewLoggingInterceptor returns a built-in AgentInterceptor that logs
+// every packet via klog at verbosity level v, replacing the ad-hoc
+// klog.Infof("[tracing] ...") calls that used to be in Serve.
+func NewLoggingInterceptor(v klog.Level) AgentInterceptor {
+	return func(ctx context.Context, dir Direction, pkt *agent.Packet, next func(context.Context, *agent.Packet) error) error {
+		direction := "inbound"
+		if dir == Outbound {
+			direction = "outbound"
+		}
+
+		klog.V(v).Infof("[%s] %s %+v", direction, pkt.Type, pkt)
+
+		return next(ctx, pkt)
+	}
+}